@@ -0,0 +1,224 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import (
+	"fmt"
+	"sync"
+
+	networking "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+const (
+	configGroup   = "networking.istio.io"
+	configVersion = "v1alpha3"
+)
+
+// ConfigStoreCache converts Cloud Foundry routes into synthetic
+// networking.ServiceEntry configs and serves them through model.ConfigStoreCache,
+// the same interface Pilot uses for Kubernetes and file-based config. It does
+// not yet replace ServiceDiscovery: this tree has no serviceentry.Controller
+// (or any other ServiceEntry consumer) to register it with, so CF routes are
+// still served to Pilot through ServiceDiscovery/Controller in
+// servicediscovery.go, and ConfigStoreCache is an independently usable
+// translation layer rather than the full unification a serviceentry.Controller
+// wiring would give. Once such a consumer exists, routing CF through it
+// instead would pick up workload selectors, subsets, and locality for free,
+// on top of the endpoint labels this type already carries over.
+type ConfigStoreCache struct {
+	controller *Controller
+
+	mu       sync.RWMutex
+	handlers []func(model.Config, model.Event)
+}
+
+// NewConfigStoreCache creates a ConfigStoreCache backed by the given Controller.
+func NewConfigStoreCache(controller *Controller) *ConfigStoreCache {
+	return &ConfigStoreCache{controller: controller}
+}
+
+// ConfigDescriptor implements model.ConfigStore. Cloud Foundry routes are only
+// ever surfaced as ServiceEntry configs.
+func (cs *ConfigStoreCache) ConfigDescriptor() model.ConfigDescriptor {
+	return model.ConfigDescriptor{model.ServiceEntry}
+}
+
+// Get implements model.ConfigStore
+func (cs *ConfigStoreCache) Get(typ, name, namespace string) (*model.Config, bool) {
+	if typ != model.ServiceEntry.Type {
+		return nil, false
+	}
+	for _, cfg := range cs.list() {
+		if cfg.Name == name && cfg.Namespace == namespace {
+			found := cfg
+			return &found, true
+		}
+	}
+	return nil, false
+}
+
+// List implements model.ConfigStore, returning one synthetic ServiceEntry per
+// Cloud Foundry route currently cached by the Controller.
+func (cs *ConfigStoreCache) List(typ, namespace string) ([]model.Config, error) {
+	if typ != model.ServiceEntry.Type {
+		return nil, nil
+	}
+	return cs.list(), nil
+}
+
+func (cs *ConfigStoreCache) list() []model.Config {
+	cs.controller.mu.RLock()
+	defer cs.controller.mu.RUnlock()
+
+	configs := make([]model.Config, 0, len(cs.controller.services))
+	for hostname, svc := range cs.controller.services {
+		configs = append(configs, serviceEntryConfig(hostname, svc, cs.controller.instances[hostname]))
+	}
+	return configs
+}
+
+// Create is not supported: Cloud Foundry routes are only ever read from
+// Copilot, never written back through the config API.
+func (cs *ConfigStoreCache) Create(model.Config) (string, error) {
+	return "", fmt.Errorf("cloudfoundry: config store is read-only")
+}
+
+// Update is not supported, see Create.
+func (cs *ConfigStoreCache) Update(model.Config) (string, error) {
+	return "", fmt.Errorf("cloudfoundry: config store is read-only")
+}
+
+// Delete is not supported, see Create.
+func (cs *ConfigStoreCache) Delete(typ, name, namespace string) error {
+	return fmt.Errorf("cloudfoundry: config store is read-only")
+}
+
+// RegisterEventHandler implements model.ConfigStoreCache
+func (cs *ConfigStoreCache) RegisterEventHandler(typ string, handler func(model.Config, model.Event)) {
+	if typ != model.ServiceEntry.Type {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.handlers = append(cs.handlers, handler)
+}
+
+// Run implements model.ConfigStoreCache by driving the underlying Controller and
+// translating its service and instance events into ServiceEntry events for any
+// handler registered above.
+func (cs *ConfigStoreCache) Run(stop <-chan struct{}) {
+	cs.registerHandlers()
+	cs.controller.Run(stop)
+}
+
+// registerHandlers wires a combined ServiceEntry notification off both of the
+// Controller's handlers. A service handler alone would miss the common CF
+// case of an app scaling up or down: diffServices only fires when the
+// aggregate Service fields change, not when a hostname's backend set does, so
+// an instance handler is needed too or a scaling event would never produce a
+// Config event until the next List().
+func (cs *ConfigStoreCache) registerHandlers() {
+	notify := func(hostname model.Hostname, svc *model.Service, event model.Event) {
+		if svc == nil {
+			return
+		}
+		cfg := serviceEntryConfig(hostname, svc, cs.controller.cachedInstancesByPort(hostname))
+
+		cs.mu.RLock()
+		handlers := append([]func(model.Config, model.Event){}, cs.handlers...)
+		cs.mu.RUnlock()
+		for _, handler := range handlers {
+			handler(cfg, event)
+		}
+	}
+
+	_ = cs.controller.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		notify(svc.Hostname, svc, event)
+	})
+	_ = cs.controller.AppendInstanceHandler(func(instance *model.ServiceInstance, event model.Event) {
+		notify(instance.Service.Hostname, instance.Service, event)
+	})
+}
+
+// HasSynced implements model.ConfigStoreCache. It reflects the Controller
+// actually having completed a successful refresh, not just Run having been
+// called, so a caller gating an initial xDS push on this doesn't push an
+// empty CF service set before the first Copilot fetch lands.
+func (cs *ConfigStoreCache) HasSynced() bool {
+	return cs.controller.Synced()
+}
+
+// serviceEntryConfig converts a single Cloud Foundry route into a synthetic
+// ServiceEntry config. Internal routes carry a
+// VIP and are addressable by it; public routes have no VIP and resolve
+// directly to their backend endpoints, the same client-side load balancing
+// ServiceDiscovery.Services configured by hand before this controller existed.
+// Location and Resolution are carried over from svc rather than hardcoded, so
+// an egress host (MeshExternal, DNSLB, no backing instances) comes out as a
+// MESH_EXTERNAL/DNS ServiceEntry that Envoy resolves itself, instead of a
+// STATIC one with zero endpoints.
+func serviceEntryConfig(hostname model.Hostname, svc *model.Service, instances []*model.ServiceInstance) model.Config {
+	ports := make([]*networking.Port, 0, len(svc.Ports))
+	for _, p := range svc.Ports {
+		ports = append(ports, &networking.Port{
+			Number:   uint32(p.Port),
+			Protocol: string(p.Protocol),
+			Name:     p.Name,
+		})
+	}
+
+	endpoints := make([]*networking.ServiceEntry_Endpoint, 0, len(instances))
+	for _, instance := range instances {
+		endpoints = append(endpoints, &networking.ServiceEntry_Endpoint{
+			Address: instance.Endpoint.Address,
+			Ports:   map[string]uint32{instance.Endpoint.ServicePort.Name: uint32(instance.Endpoint.Port)},
+			Labels:  map[string]string(instance.Labels),
+		})
+	}
+
+	location := networking.ServiceEntry_MESH_INTERNAL
+	if svc.MeshExternal {
+		location = networking.ServiceEntry_MESH_EXTERNAL
+	}
+
+	resolution := networking.ServiceEntry_STATIC
+	if svc.Resolution == model.DNSLB {
+		resolution = networking.ServiceEntry_DNS
+	}
+
+	entry := &networking.ServiceEntry{
+		Hosts:      []string{hostname.String()},
+		Ports:      ports,
+		Location:   location,
+		Resolution: resolution,
+		Endpoints:  endpoints,
+	}
+	if svc.Address != "" {
+		entry.Addresses = []string{svc.Address}
+	}
+
+	return model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Type:      model.ServiceEntry.Type,
+			Group:     configGroup,
+			Version:   configVersion,
+			Name:      hostname.String(),
+			Namespace: model.IstioDefaultConfigNamespace,
+		},
+		Spec: entry,
+	}
+}
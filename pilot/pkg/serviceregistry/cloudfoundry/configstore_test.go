@@ -0,0 +1,179 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import (
+	"testing"
+
+	networking "istio.io/api/networking/v1alpha3"
+
+	copilotapi "code.cloudfoundry.org/copilot/api"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestServiceEntryConfigInternalRoute(t *testing.T) {
+	svc := &model.Service{
+		Hostname:     "internal.apps.internal",
+		Address:      "10.255.0.1",
+		Ports:        []*model.Port{{Port: 8080, Protocol: model.ProtocolHTTP, Name: "http"}},
+		MeshExternal: false,
+		Resolution:   model.ClientSideLB,
+	}
+	instances := []*model.ServiceInstance{{
+		Endpoint: model.NetworkEndpoint{
+			Address:     "10.0.0.1",
+			Port:        8080,
+			ServicePort: svc.Ports[0],
+		},
+	}}
+
+	cfg := serviceEntryConfig(svc.Hostname, svc, instances)
+	entry := cfg.Spec.(*networking.ServiceEntry)
+
+	if entry.Location != networking.ServiceEntry_MESH_INTERNAL {
+		t.Errorf("expected MESH_INTERNAL for an internal route, got %v", entry.Location)
+	}
+	if entry.Resolution != networking.ServiceEntry_STATIC {
+		t.Errorf("expected STATIC resolution for a client-side-LB route, got %v", entry.Resolution)
+	}
+	if len(entry.Addresses) != 1 || entry.Addresses[0] != "10.255.0.1" {
+		t.Errorf("expected the VIP to be carried over as the ServiceEntry address, got %v", entry.Addresses)
+	}
+	if len(entry.Endpoints) != 1 {
+		t.Errorf("expected 1 endpoint, got %d", len(entry.Endpoints))
+	}
+}
+
+func TestServiceEntryConfigPublicRoute(t *testing.T) {
+	svc := &model.Service{
+		Hostname:     "public.apps.example.com",
+		Ports:        []*model.Port{{Port: 8080, Protocol: model.ProtocolHTTP, Name: "http"}},
+		MeshExternal: false,
+		Resolution:   model.ClientSideLB,
+	}
+
+	cfg := serviceEntryConfig(svc.Hostname, svc, nil)
+	entry := cfg.Spec.(*networking.ServiceEntry)
+
+	if entry.Location != networking.ServiceEntry_MESH_INTERNAL {
+		t.Errorf("expected MESH_INTERNAL for a public CF route (still inside the mesh), got %v", entry.Location)
+	}
+	if len(entry.Addresses) != 0 {
+		t.Errorf("expected no VIP address for a public route, got %v", entry.Addresses)
+	}
+}
+
+func TestServiceEntryConfigEgressRoute(t *testing.T) {
+	svc := &model.Service{
+		Hostname:     "api.partner.com",
+		Ports:        []*model.Port{{Port: 443, Protocol: model.ProtocolHTTPS, Name: "https"}},
+		MeshExternal: true,
+		Resolution:   model.DNSLB,
+	}
+
+	// Egress hosts have no backing ServiceInstances: InstancesByPort returns
+	// nil for them, since they resolve via DNS at the proxy instead of a
+	// Copilot-tracked backend set.
+	cfg := serviceEntryConfig(svc.Hostname, svc, nil)
+	entry := cfg.Spec.(*networking.ServiceEntry)
+
+	if entry.Location != networking.ServiceEntry_MESH_EXTERNAL {
+		t.Errorf("expected MESH_EXTERNAL for an egress host, got %v", entry.Location)
+	}
+	if entry.Resolution != networking.ServiceEntry_DNS {
+		t.Errorf("expected DNS resolution for an egress host, so Envoy resolves it "+
+			"itself instead of blackholing a STATIC cluster with zero endpoints, got %v", entry.Resolution)
+	}
+	if len(entry.Endpoints) != 0 {
+		t.Errorf("expected no endpoints for an egress host, got %d", len(entry.Endpoints))
+	}
+}
+
+func TestServiceEntryConfigCarriesEndpointLabels(t *testing.T) {
+	svc := &model.Service{
+		Hostname: "internal.apps.internal",
+		Ports:    []*model.Port{{Port: 8080, Protocol: model.ProtocolHTTP, Name: "http"}},
+	}
+	instances := []*model.ServiceInstance{{
+		Endpoint: model.NetworkEndpoint{Address: "10.0.0.1", Port: 8080, ServicePort: svc.Ports[0]},
+		Labels:   model.Labels{"cloudfoundry.org/app-guid": "abc-123"},
+	}}
+
+	cfg := serviceEntryConfig(svc.Hostname, svc, instances)
+	entry := cfg.Spec.(*networking.ServiceEntry)
+
+	if len(entry.Endpoints) != 1 || entry.Endpoints[0].Labels["cloudfoundry.org/app-guid"] != "abc-123" {
+		t.Errorf("expected the instance's labels to carry over to the ServiceEntry endpoint, got %+v", entry.Endpoints)
+	}
+}
+
+func TestConfigStoreCacheHasSyncedWaitsForFirstRefresh(t *testing.T) {
+	discovery := &ServiceDiscovery{Client: &fakeCopilotClient{}}
+	controller := NewController(discovery)
+	cs := NewConfigStoreCache(controller)
+
+	if cs.HasSynced() {
+		t.Error("expected HasSynced to be false before any refresh has completed")
+	}
+
+	if err := controller.refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !cs.HasSynced() {
+		t.Error("expected HasSynced to be true once a refresh has completed")
+	}
+}
+
+func TestConfigStoreCacheInstanceOnlyChangeFiresConfigEvent(t *testing.T) {
+	hostname := "app.example.com"
+	backend := func(port int32) *copilotapi.RoutesResponse {
+		return &copilotapi.RoutesResponse{
+			Backends: map[string]*copilotapi.BackendSet{
+				hostname: {Backends: []*copilotapi.Backend{{Address: "10.0.0.1", Port: port}}},
+			},
+		}
+	}
+	client := &fakeCopilotClient{routesResp: backend(8080)}
+	discovery := &ServiceDiscovery{Client: client, ServicePort: 8080}
+	controller := NewController(discovery)
+	cs := NewConfigStoreCache(controller)
+	cs.registerHandlers()
+
+	if err := controller.refresh(); err != nil {
+		t.Fatalf("unexpected error on first refresh: %v", err)
+	}
+
+	var gotEvents []model.Event
+	cs.RegisterEventHandler(model.ServiceEntry.Type, func(_ model.Config, event model.Event) {
+		gotEvents = append(gotEvents, event)
+	})
+
+	// Scale the app to a second instance without changing any Service field:
+	// diffServices alone would miss this, since Hostname/Ports/Address/
+	// MeshExternal/Resolution are all unchanged.
+	client.routesResp.Backends[hostname].Backends = append(
+		client.routesResp.Backends[hostname].Backends,
+		&copilotapi.Backend{Address: "10.0.0.2", Port: 8080},
+	)
+	if err := controller.refresh(); err != nil {
+		t.Fatalf("unexpected error on second refresh: %v", err)
+	}
+
+	if len(gotEvents) == 0 {
+		t.Error("expected an instance-only backend change to still produce a Config event")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"istio.io/istio/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+const (
+	defaultResyncInterval = 5 * time.Second
+	defaultMinBackoff     = 1 * time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// Controller keeps an in-memory cache of the services and instances backing a
+// ServiceDiscovery's Copilot client, and serves ServiceDiscovery reads from
+// that cache once wired up via ServiceDiscovery.Controller (see
+// cachedServices/cachedInstancesByPort/cachedInstances below). It implements
+// model.Controller so Pilot's xDS layer can be pushed updates only when the
+// cache actually changes.
+//
+// The copilotClient interface this package talks to only exposes the unary
+// Routes/InternalRoutes RPCs; there is no server-streaming route subscription
+// to open, so the cache is refreshed on a fixed interval instead, with
+// exponential backoff on RPC failure and a reset to resyncInterval once a
+// refresh succeeds. Each refresh calls ServiceDiscovery.snapshot exactly once,
+// which itself makes exactly the Routes/InternalRoutes RPC pair regardless of
+// how many hostnames or instances they describe, so a resync doesn't get more
+// expensive as route counts grow. Diffing the result against the previous
+// cache is what turns that resync into the add/update/delete events handlers
+// expect.
+type Controller struct {
+	discovery      *ServiceDiscovery
+	resyncInterval time.Duration
+
+	mu          sync.RWMutex
+	services    map[model.Hostname]*model.Service
+	instances   map[model.Hostname][]*model.ServiceInstance
+	ip2instance map[string][]*model.ServiceInstance
+	lastRefresh time.Time
+
+	serviceHandlers  []func(*model.Service, model.Event)
+	instanceHandlers []func(*model.ServiceInstance, model.Event)
+}
+
+// NewController creates a Controller that keeps its cache populated by polling the
+// given ServiceDiscovery's Copilot client.
+func NewController(discovery *ServiceDiscovery) *Controller {
+	return &Controller{
+		discovery:      discovery,
+		resyncInterval: defaultResyncInterval,
+		services:       make(map[model.Hostname]*model.Service),
+		instances:      make(map[model.Hostname][]*model.ServiceInstance),
+		ip2instance:    make(map[string][]*model.ServiceInstance),
+	}
+}
+
+// AppendServiceHandler implements model.Controller
+func (c *Controller) AppendServiceHandler(f func(*model.Service, model.Event)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serviceHandlers = append(c.serviceHandlers, f)
+	return nil
+}
+
+// AppendInstanceHandler implements model.Controller
+func (c *Controller) AppendInstanceHandler(f func(*model.ServiceInstance, model.Event)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instanceHandlers = append(c.instanceHandlers, f)
+	return nil
+}
+
+// Run implements model.Controller. It refreshes the cache from Copilot until stop is
+// closed, backing off on repeated RPC failures and resetting to resyncInterval once a
+// refresh succeeds.
+func (c *Controller) Run(stop <-chan struct{}) {
+	backoff := defaultMinBackoff
+	for {
+		if err := c.refresh(); err != nil {
+			log.Errorf("cloudfoundry: refreshing copilot cache: %v", err)
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return
+			}
+			backoff *= 2
+			if backoff > defaultMaxBackoff {
+				backoff = defaultMaxBackoff
+			}
+			continue
+		}
+
+		backoff = defaultMinBackoff
+		select {
+		case <-time.After(c.resyncInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Synced reports whether the cache has completed at least one successful
+// refresh from Copilot. Callers gating an initial push on synced state (e.g.
+// ConfigStoreCache.HasSynced) should consult this instead of assuming Run
+// entry means the cache already has data.
+func (c *Controller) Synced() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.lastRefresh.IsZero()
+}
+
+// CacheAge reports how long it has been since the cache was last refreshed
+// successfully, so callers can alert on stale Copilot data.
+func (c *Controller) CacheAge() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lastRefresh.IsZero() {
+		return 0
+	}
+	return time.Since(c.lastRefresh)
+}
+
+// cachedServices returns a snapshot of the Controller's current service cache.
+func (c *Controller) cachedServices() []*model.Service {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	services := make([]*model.Service, 0, len(c.services))
+	for _, svc := range c.services {
+		services = append(services, svc)
+	}
+	return services
+}
+
+// cachedInstancesByPort returns the Controller's cached instances for hostname.
+func (c *Controller) cachedInstancesByPort(hostname model.Hostname) []*model.ServiceInstance {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.instances[hostname]
+}
+
+// cachedInstances returns the Controller's cached instances registered at address.
+func (c *Controller) cachedInstances(address string) []*model.ServiceInstance {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ip2instance[address]
+}
+
+// refresh pulls the current set of services and instances from Copilot, diffs them
+// against the cache, and fires the registered handlers for anything that changed.
+func (c *Controller) refresh() error {
+	services, instances, err := c.discovery.snapshot()
+	if err != nil {
+		return err
+	}
+	newServices := make(map[model.Hostname]*model.Service, len(services))
+	for _, svc := range services {
+		newServices[svc.Hostname] = svc
+	}
+	newIP2Instance := ip2InstanceFrom(instances)
+
+	c.mu.Lock()
+	oldServices := c.services
+	oldInstances := c.instances
+	c.services = newServices
+	c.instances = instances
+	c.ip2instance = newIP2Instance
+	c.lastRefresh = time.Now()
+	serviceHandlers := append([]func(*model.Service, model.Event){}, c.serviceHandlers...)
+	instanceHandlers := append([]func(*model.ServiceInstance, model.Event){}, c.instanceHandlers...)
+	c.mu.Unlock()
+
+	for _, e := range diffServices(oldServices, newServices) {
+		notifyServiceHandlers(serviceHandlers, e.service, e.event)
+	}
+	for _, e := range diffInstances(oldInstances, instances) {
+		notifyInstanceHandlers(instanceHandlers, e.instance, e.event)
+	}
+
+	return nil
+}
+
+// serviceEvent pairs a model.Service with the model.Event diffServices
+// determined for it.
+type serviceEvent struct {
+	service *model.Service
+	event   model.Event
+}
+
+// diffServices compares two hostname->Service snapshots and returns the
+// add/update/delete events needed to bring handlers watching old up to new.
+func diffServices(old, new map[model.Hostname]*model.Service) []serviceEvent {
+	var events []serviceEvent
+	for hostname, svc := range new {
+		oldSvc, existed := old[hostname]
+		switch {
+		case !existed:
+			events = append(events, serviceEvent{svc, model.EventAdd})
+		case !reflect.DeepEqual(oldSvc, svc):
+			events = append(events, serviceEvent{svc, model.EventUpdate})
+		}
+	}
+	for hostname, svc := range old {
+		if _, stillExists := new[hostname]; !stillExists {
+			events = append(events, serviceEvent{svc, model.EventDelete})
+		}
+	}
+	return events
+}
+
+// instanceEvent pairs a model.ServiceInstance with the model.Event
+// diffInstances determined for it.
+type instanceEvent struct {
+	instance *model.ServiceInstance
+	event    model.Event
+}
+
+// diffInstances compares two hostname->instances snapshots and returns the
+// add/update/delete events needed to bring handlers watching old up to new.
+// A hostname that is new gets EventAdd for all of its instances; a hostname
+// that disappears entirely gets EventDelete for all of its old instances, so
+// consumers relying on instance events to retract stale endpoints actually
+// see the retraction instead of leaking them.
+func diffInstances(old, new map[model.Hostname][]*model.ServiceInstance) []instanceEvent {
+	var events []instanceEvent
+	for hostname, instances := range new {
+		oldInstances, existed := old[hostname]
+		switch {
+		case !existed:
+			for _, instance := range instances {
+				events = append(events, instanceEvent{instance, model.EventAdd})
+			}
+		case !reflect.DeepEqual(oldInstances, instances):
+			for _, instance := range instances {
+				events = append(events, instanceEvent{instance, model.EventUpdate})
+			}
+		}
+	}
+	for hostname, instances := range old {
+		if _, stillExists := new[hostname]; !stillExists {
+			for _, instance := range instances {
+				events = append(events, instanceEvent{instance, model.EventDelete})
+			}
+		}
+	}
+	return events
+}
+
+func notifyServiceHandlers(handlers []func(*model.Service, model.Event), svc *model.Service, event model.Event) {
+	for _, handler := range handlers {
+		handler(svc, event)
+	}
+}
+
+func notifyInstanceHandlers(handlers []func(*model.ServiceInstance, model.Event), instance *model.ServiceInstance, event model.Event) {
+	for _, handler := range handlers {
+		handler(instance, event)
+	}
+}
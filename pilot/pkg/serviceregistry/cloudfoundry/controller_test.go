@@ -0,0 +1,134 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestDiffServicesAddUpdateDelete(t *testing.T) {
+	added := &model.Service{Hostname: "added.example.com"}
+	unchanged := &model.Service{Hostname: "unchanged.example.com"}
+	updatedOld := &model.Service{Hostname: "updated.example.com", Address: "1.1.1.1"}
+	updatedNew := &model.Service{Hostname: "updated.example.com", Address: "2.2.2.2"}
+	deleted := &model.Service{Hostname: "deleted.example.com"}
+
+	old := map[model.Hostname]*model.Service{
+		"unchanged.example.com": unchanged,
+		"updated.example.com":   updatedOld,
+		"deleted.example.com":   deleted,
+	}
+	new := map[model.Hostname]*model.Service{
+		"unchanged.example.com": unchanged,
+		"updated.example.com":   updatedNew,
+		"added.example.com":     added,
+	}
+
+	events := diffServices(old, new)
+
+	byHost := map[model.Hostname]model.Event{}
+	for _, e := range events {
+		byHost[e.service.Hostname] = e.event
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d: %+v", len(events), events)
+	}
+	if byHost["added.example.com"] != model.EventAdd {
+		t.Errorf("expected EventAdd for added host, got %v", byHost["added.example.com"])
+	}
+	if byHost["updated.example.com"] != model.EventUpdate {
+		t.Errorf("expected EventUpdate for changed host, got %v", byHost["updated.example.com"])
+	}
+	if byHost["deleted.example.com"] != model.EventDelete {
+		t.Errorf("expected EventDelete for removed host, got %v", byHost["deleted.example.com"])
+	}
+	if _, ok := byHost["unchanged.example.com"]; ok {
+		t.Error("expected no event for unchanged host")
+	}
+}
+
+func TestDiffInstancesNewHostnameIsAdd(t *testing.T) {
+	instance := &model.ServiceInstance{Endpoint: model.NetworkEndpoint{Address: "10.0.0.1"}}
+	old := map[model.Hostname][]*model.ServiceInstance{}
+	new := map[model.Hostname][]*model.ServiceInstance{
+		"new.example.com": {instance},
+	}
+
+	events := diffInstances(old, new)
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d: %+v", len(events), events)
+	}
+	if events[0].event != model.EventAdd {
+		t.Errorf("expected EventAdd for a brand-new hostname, got %v", events[0].event)
+	}
+}
+
+func TestDiffInstancesRemovedHostnameIsDelete(t *testing.T) {
+	instance := &model.ServiceInstance{Endpoint: model.NetworkEndpoint{Address: "10.0.0.1"}}
+	old := map[model.Hostname][]*model.ServiceInstance{
+		"gone.example.com": {instance},
+	}
+	new := map[model.Hostname][]*model.ServiceInstance{}
+
+	events := diffInstances(old, new)
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d: %+v", len(events), events)
+	}
+	if events[0].event != model.EventDelete {
+		t.Errorf("expected EventDelete when a hostname disappears entirely, got %v", events[0].event)
+	}
+	if events[0].instance != instance {
+		t.Error("expected the deleted event to carry the stale instance so it can be retracted")
+	}
+}
+
+func TestDiffInstancesChangedIsUpdate(t *testing.T) {
+	oldInstance := &model.ServiceInstance{Endpoint: model.NetworkEndpoint{Address: "10.0.0.1"}}
+	newInstance := &model.ServiceInstance{Endpoint: model.NetworkEndpoint{Address: "10.0.0.2"}}
+	old := map[model.Hostname][]*model.ServiceInstance{
+		"app.example.com": {oldInstance},
+	}
+	new := map[model.Hostname][]*model.ServiceInstance{
+		"app.example.com": {newInstance},
+	}
+
+	events := diffInstances(old, new)
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d: %+v", len(events), events)
+	}
+	if events[0].event != model.EventUpdate {
+		t.Errorf("expected EventUpdate for a changed instance set, got %v", events[0].event)
+	}
+}
+
+func TestDiffInstancesUnchangedIsNoEvent(t *testing.T) {
+	instance := &model.ServiceInstance{Endpoint: model.NetworkEndpoint{Address: "10.0.0.1"}}
+	old := map[model.Hostname][]*model.ServiceInstance{
+		"app.example.com": {instance},
+	}
+	new := map[model.Hostname][]*model.ServiceInstance{
+		"app.example.com": {instance},
+	}
+
+	if events := diffInstances(old, new); len(events) != 0 {
+		t.Errorf("expected no events for an unchanged instance set, got %+v", events)
+	}
+}
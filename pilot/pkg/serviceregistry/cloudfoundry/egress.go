@@ -0,0 +1,114 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// EgressPort overrides the protocol Pilot assumes for one port of an egress
+// host, the same way a route's PortResolver can override the protocol of a
+// CF-internal port.
+type EgressPort struct {
+	Number   int    `json:"number" yaml:"number"`
+	Protocol string `json:"protocol" yaml:"protocol"`
+}
+
+// EgressRule describes one external destination Cloud Foundry apps are allowed
+// to reach directly, bypassing Copilot route discovery entirely. Host supports
+// a single leading wildcard label (e.g. "*.example.com").
+type EgressRule struct {
+	Host  string       `json:"host" yaml:"host"`
+	Ports []EgressPort `json:"ports" yaml:"ports"`
+}
+
+// EgressRuleset is a loaded collection of EgressRules. A nil *EgressRuleset
+// behaves as an empty one, so ServiceDiscovery does not need a nil check
+// before using its Egress field.
+type EgressRuleset struct {
+	rules []EgressRule
+}
+
+// LoadEgressRuleset reads an egress ruleset from a YAML file on disk. The file
+// format is a plain list of EgressRule.
+func LoadEgressRuleset(path string) (*EgressRuleset, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading egress ruleset: %s", err)
+	}
+	var rules []EgressRule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing egress ruleset: %s", err)
+	}
+	return &EgressRuleset{rules: rules}, nil
+}
+
+// Services returns one model.Service per configured egress rule, each marked
+// MeshExternal with DNS resolution so Pilot generates egress listeners for it
+// alongside the CF-internal routes ServiceDiscovery.Services already returns.
+func (rs *EgressRuleset) Services() []*model.Service {
+	if rs == nil {
+		return nil
+	}
+	services := make([]*model.Service, 0, len(rs.rules))
+	for _, rule := range rs.rules {
+		ports := make([]*model.Port, 0, len(rule.Ports))
+		for _, p := range rule.Ports {
+			ports = append(ports, &model.Port{
+				Port:     p.Number,
+				Protocol: model.ParseProtocol(p.Protocol),
+				Name:     strings.ToLower(p.Protocol),
+			})
+		}
+		services = append(services, &model.Service{
+			Hostname:     model.Hostname(rule.Host),
+			Ports:        ports,
+			MeshExternal: true,
+			Resolution:   model.DNSLB,
+		})
+	}
+	return services
+}
+
+// Matches reports whether hostname satisfies one of the ruleset's egress hosts,
+// including a single leading wildcard label such as "*.example.com".
+func (rs *EgressRuleset) Matches(hostname model.Hostname) bool {
+	if rs == nil {
+		return false
+	}
+	host := hostname.String()
+	for _, rule := range rs.rules {
+		if hostMatches(rule.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostMatches(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return false
+}
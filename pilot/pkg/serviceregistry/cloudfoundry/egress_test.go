@@ -0,0 +1,64 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import "testing"
+
+func TestHostMatches(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "other.com", false},
+		{"*.example.com", "foo.example.com", true},
+		{"*.example.com", "foo.bar.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "notexample.com", false},
+	}
+	for _, c := range cases {
+		if got := hostMatches(c.pattern, c.host); got != c.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", c.pattern, c.host, got, c.want)
+		}
+	}
+}
+
+func TestEgressRulesetMatches(t *testing.T) {
+	rs := &EgressRuleset{rules: []EgressRule{
+		{Host: "api.example.com"},
+		{Host: "*.partner.com"},
+	}}
+
+	if !rs.Matches("api.example.com") {
+		t.Error("expected exact host match")
+	}
+	if !rs.Matches("billing.partner.com") {
+		t.Error("expected wildcard host match")
+	}
+	if rs.Matches("unrelated.com") {
+		t.Error("expected no match for unrelated host")
+	}
+}
+
+func TestNilEgressRulesetMatches(t *testing.T) {
+	var rs *EgressRuleset
+	if rs.Matches("anything.com") {
+		t.Error("expected nil EgressRuleset to match nothing")
+	}
+	if rs.Services() != nil {
+		t.Error("expected nil EgressRuleset to contribute no services")
+	}
+}
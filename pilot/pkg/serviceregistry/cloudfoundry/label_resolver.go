@@ -0,0 +1,73 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import "istio.io/istio/pilot/pkg/model"
+
+// LabelResolver resolves the labels (app GUID, space, org) Pilot needs on a
+// ServiceInstance to generate inbound listeners for the CF sidecar collocated
+// with it. It exists as its own extension point, mirroring PortResolver,
+// because the Routes/InternalRoutes RPCs this package calls carry only route
+// hostnames and backend addresses/ports, not CAPI metadata: this package has
+// no CAPI (or BBS) client of its own to auto-discover GUID/space/org from, so
+// there is no auto-deriving default the way discoverPorts is for PortResolver.
+// NewStaticLabelResolver covers the case where a caller already knows the
+// mapping (e.g. from its own CAPI polling) and just needs to hand it in;
+// a real CAPI-backed, auto-discovering resolver remains out of scope until
+// this package has a CAPI client to build one against.
+type LabelResolver interface {
+	// ResolveLabels returns the labels for hostname, or nil if nothing is
+	// known about it.
+	ResolveLabels(hostname model.Hostname) model.Labels
+}
+
+// noopLabelResolver is the default LabelResolver: it never has labels to
+// report, since ServiceDiscovery has no CAPI metadata of its own to draw on.
+type noopLabelResolver struct{}
+
+// ResolveLabels implements LabelResolver
+func (noopLabelResolver) ResolveLabels(model.Hostname) model.Labels {
+	return nil
+}
+
+// staticLabelResolver resolves labels from a hostname->labels table supplied
+// at construction time, for callers that already have the CF GUID/space/org
+// mapping from their own CAPI polling and just need it threaded through to
+// ServiceInstance.Labels.
+type staticLabelResolver struct {
+	labels map[model.Hostname]model.Labels
+}
+
+// NewStaticLabelResolver builds a LabelResolver from an explicit
+// hostname->labels table. Hostnames missing from the table resolve to nil,
+// the same as the noop default.
+func NewStaticLabelResolver(labels map[model.Hostname]model.Labels) LabelResolver {
+	return &staticLabelResolver{labels: labels}
+}
+
+// ResolveLabels implements LabelResolver
+func (r *staticLabelResolver) ResolveLabels(hostname model.Hostname) model.Labels {
+	return r.labels[hostname]
+}
+
+// labelResolver returns sd.LabelResolver, defaulting to noopLabelResolver so
+// every ServiceInstance built by this package always goes through a resolver,
+// even when the caller hasn't configured one.
+func (sd *ServiceDiscovery) labelResolver() LabelResolver {
+	if sd.LabelResolver != nil {
+		return sd.LabelResolver
+	}
+	return noopLabelResolver{}
+}
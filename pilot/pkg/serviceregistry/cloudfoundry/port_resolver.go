@@ -0,0 +1,113 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import (
+	"fmt"
+
+	copilotapi "code.cloudfoundry.org/copilot/api"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// PortResolver resolves the model.Port(s) that a Cloud Foundry route's backends
+// listen on. It exists because real CF apps can expose more than the single
+// hardcoded HTTP port ServiceDiscovery otherwise assumes: apps that opt in to
+// HTTP/2, gRPC, or raw TCP need their own port and protocol advertised instead.
+//
+// ServiceDiscovery only consults a configured PortResolver for explicit,
+// operator-supplied overrides (e.g. "this hostname is gRPC, not HTTP"). When
+// none is configured, it falls back to discoverPorts below, which derives the
+// port list straight from the backend ports Copilot already reports on the
+// wire, rather than a static table that has to be kept in sync by hand.
+type PortResolver interface {
+	// ResolvePorts returns the ports for hostname. If nothing more specific is
+	// known about hostname, implementations should return fallback unchanged.
+	ResolvePorts(hostname model.Hostname, fallback *model.Port) []*model.Port
+}
+
+// staticPortResolver resolves ports from a hostname->ports table supplied at
+// construction time, for operators who need to override the protocol
+// discoverPorts would otherwise guess (e.g. declaring a route HTTP/2 or gRPC).
+type staticPortResolver struct {
+	ports map[model.Hostname][]*model.Port
+}
+
+// NewPortResolver builds a PortResolver from an explicit hostname->ports
+// table, falling back to the caller-supplied port for any hostname it doesn't
+// cover. Use this to override the protocol/name discoverPorts would otherwise
+// assign; leave ServiceDiscovery.PortResolver unset to use discoverPorts alone.
+func NewPortResolver(ports map[model.Hostname][]*model.Port) PortResolver {
+	return &staticPortResolver{ports: ports}
+}
+
+// ResolvePorts implements PortResolver
+func (r *staticPortResolver) ResolvePorts(hostname model.Hostname, fallback *model.Port) []*model.Port {
+	if ports, ok := r.ports[hostname]; ok && len(ports) > 0 {
+		return ports
+	}
+	return []*model.Port{fallback}
+}
+
+// discoverPorts builds the default port list for a route directly from the
+// distinct ports its own backends report, so an app that exposes more than
+// the single hardcoded ServicePort isn't collapsed onto it. Every discovered
+// port keeps fallback's protocol, since the Routes/InternalRoutes RPCs this
+// package calls carry a backend's port number but no protocol hint. A port
+// equal to fallback's reuses fallback itself; any other port is named
+// "<fallback name>-<port>" (e.g. "http-9090").
+//
+// Known limitation: a route whose backends actually speak different
+// protocols on different ports (e.g. HTTP/2 on one port, gRPC or raw TCP on
+// another) still gets fallback's protocol reported for every discovered port,
+// since there's no protocol signal on the wire to tell them apart. Per-port
+// protocol correctly falls out only when an operator configures
+// ServiceDiscovery.PortResolver with the right protocol for each port by hand.
+func discoverPorts(backends []*copilotapi.Backend, fallback *model.Port) []*model.Port {
+	if len(backends) == 0 {
+		return []*model.Port{fallback}
+	}
+	var ports []*model.Port
+	seen := make(map[int32]bool, len(backends))
+	for _, backend := range backends {
+		if seen[backend.Port] {
+			continue
+		}
+		seen[backend.Port] = true
+		if backend.Port == int32(fallback.Port) {
+			ports = append(ports, fallback)
+			continue
+		}
+		ports = append(ports, &model.Port{
+			Port:     int(backend.Port),
+			Protocol: fallback.Protocol,
+			Name:     fmt.Sprintf("%s-%d", fallback.Name, backend.Port),
+		})
+	}
+	return ports
+}
+
+// matchPort returns the port in ports whose Port number matches backendPort, or
+// the first port in ports if none matches, so a NetworkEndpoint.ServicePort
+// always reflects the port a given backend actually listens on even when a
+// route advertises more than one.
+func matchPort(ports []*model.Port, backendPort int32) *model.Port {
+	for _, p := range ports {
+		if p.Port == int(backendPort) {
+			return p
+		}
+	}
+	return ports[0]
+}
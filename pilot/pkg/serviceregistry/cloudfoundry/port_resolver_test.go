@@ -0,0 +1,75 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import (
+	"testing"
+
+	copilotapi "code.cloudfoundry.org/copilot/api"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestDiscoverPortsNoBackendsFallsBack(t *testing.T) {
+	fallback := &model.Port{Port: 8080, Protocol: model.ProtocolHTTP, Name: "http"}
+	ports := discoverPorts(nil, fallback)
+	if len(ports) != 1 || ports[0] != fallback {
+		t.Errorf("expected discoverPorts with no backends to return fallback unchanged, got %+v", ports)
+	}
+}
+
+func TestDiscoverPortsSinglePortMatchesFallback(t *testing.T) {
+	fallback := &model.Port{Port: 8080, Protocol: model.ProtocolHTTP, Name: "http"}
+	backends := []*copilotapi.Backend{
+		{Address: "10.0.0.1", Port: 8080},
+		{Address: "10.0.0.2", Port: 8080},
+	}
+	ports := discoverPorts(backends, fallback)
+	if len(ports) != 1 || ports[0] != fallback {
+		t.Errorf("expected a single discovered port matching fallback to reuse it, got %+v", ports)
+	}
+}
+
+func TestDiscoverPortsMultiplePorts(t *testing.T) {
+	fallback := &model.Port{Port: 8080, Protocol: model.ProtocolHTTP, Name: "http"}
+	backends := []*copilotapi.Backend{
+		{Address: "10.0.0.1", Port: 8080},
+		{Address: "10.0.0.1", Port: 9090},
+		{Address: "10.0.0.2", Port: 9090},
+	}
+	ports := discoverPorts(backends, fallback)
+	if len(ports) != 2 {
+		t.Fatalf("expected 2 distinct discovered ports, got %+v", ports)
+	}
+	if ports[0] != fallback {
+		t.Errorf("expected the port matching fallback to reuse it, got %+v", ports[0])
+	}
+	if ports[1].Port != 9090 || ports[1].Protocol != fallback.Protocol {
+		t.Errorf("expected the extra port to keep fallback's protocol, got %+v", ports[1])
+	}
+}
+
+func TestMatchPortFallsBackToFirst(t *testing.T) {
+	ports := []*model.Port{
+		{Port: 8080, Name: "http"},
+		{Port: 9090, Name: "grpc"},
+	}
+	if got := matchPort(ports, 9090); got.Name != "grpc" {
+		t.Errorf("expected matchPort to find the matching port, got %+v", got)
+	}
+	if got := matchPort(ports, 1234); got != ports[0] {
+		t.Errorf("expected matchPort to fall back to the first port for an unknown backend port, got %+v", got)
+	}
+}
@@ -37,48 +37,36 @@ type ServiceDiscovery struct {
 	// Cloud Foundry currently only supports applications exposing a single HTTP or TCP port
 	// It is typically 8080
 	ServicePort int
+
+	// PortResolver overrides the port/protocol discoverPorts would otherwise
+	// derive for a hostname from its backends' actual ports. Optional: leave
+	// unset to use discoverPorts alone.
+	PortResolver PortResolver
+
+	// LabelResolver resolves the app GUID/space/org labels Pilot needs to
+	// generate inbound listeners for a CF sidecar. Optional: a nil
+	// LabelResolver reports no labels, since ServiceDiscovery has no CAPI
+	// metadata of its own.
+	LabelResolver LabelResolver
+
+	// Egress is the set of external hosts CF apps may reach outside the mesh.
+	// Optional: a nil Egress simply contributes no egress services.
+	Egress *EgressRuleset
+
+	// Controller, if set, serves Services, InstancesByPort, and
+	// GetProxyServiceInstances from its cache instead of issuing Copilot RPCs
+	// on every call. Optional: a nil Controller falls back to calling Copilot
+	// directly via snapshot on every read.
+	Controller *Controller
 }
 
 // Services implements a service catalog operation
 func (sd *ServiceDiscovery) Services() ([]*model.Service, error) {
-	resp, err := sd.Client.Routes(context.Background(), new(copilotapi.RoutesRequest))
-	if err != nil {
-		return nil, fmt.Errorf("getting services: %s", err)
-	}
-	services := make([]*model.Service, 0, len(resp.GetBackends()))
-
-	port := sd.servicePort()
-	for hostname := range resp.Backends {
-		services = append(services, &model.Service{
-			Hostname:     model.Hostname(hostname),
-			Ports:        []*model.Port{port},
-			MeshExternal: false,
-			Resolution:   model.ClientSideLB,
-		})
-	}
-
-	internalRoutesResp, err := sd.Client.InternalRoutes(context.Background(), new(copilotapi.InternalRoutesRequest))
-	if err != nil {
-		return nil, fmt.Errorf("getting services: %s", err)
+	if sd.Controller != nil {
+		return sd.Controller.cachedServices(), nil
 	}
-
-	internalRouteServicePort := &model.Port{
-		Port:     sd.ServicePort,
-		Protocol: model.ProtocolTCP,
-		Name:     "tcp",
-	}
-
-	for _, internalRoute := range internalRoutesResp.GetInternalRoutes() {
-		services = append(services, &model.Service{
-			Hostname:     model.Hostname(internalRoute.Hostname),
-			Address:      internalRoute.Vip,
-			Ports:        []*model.Port{internalRouteServicePort},
-			MeshExternal: false,
-			Resolution:   model.ClientSideLB,
-		})
-	}
-
-	return services, nil
+	services, _, err := sd.snapshot()
+	return services, err
 }
 
 // GetService implements a service catalog operation
@@ -102,70 +90,149 @@ func (sd *ServiceDiscovery) Instances(hostname model.Hostname, _ []string, _ mod
 
 // InstancesByPort implements a service catalog operation
 func (sd *ServiceDiscovery) InstancesByPort(hostname model.Hostname, _ []int, _ model.LabelsCollection) ([]*model.ServiceInstance, error) {
+	if sd.Egress.Matches(hostname) {
+		// Egress destinations resolve via DNS at the proxy, not through Copilot-tracked
+		// backends, so there is no ServiceInstance to report for them.
+		return nil, nil
+	}
+
+	if sd.Controller != nil {
+		return sd.Controller.cachedInstancesByPort(hostname), nil
+	}
+
+	_, instances, err := sd.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return instances[hostname], nil
+}
+
+// GetProxyServiceInstances returns all service instances running on a particular proxy
+// Cloud Foundry sidecars register with the container IP assigned to their Diego cell, so
+// this looks the proxy up in an IP-to-instance index built from the current routes (the
+// same shape as the ip2instance map the memory registry keeps for
+// GetProxyServiceTargets), letting Pilot generate inbound listeners for the collocated app.
+func (sd *ServiceDiscovery) GetProxyServiceInstances(proxy *model.Proxy) ([]*model.ServiceInstance, error) {
+	if sd.Controller != nil {
+		return sd.Controller.cachedInstances(proxy.IPAddress), nil
+	}
+
+	_, instances, err := sd.snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("getting proxy service instances: %s", err)
+	}
+	return ip2InstanceFrom(instances)[proxy.IPAddress], nil
+}
+
+// snapshot fetches Routes and InternalRoutes exactly once and builds both the
+// service list and the per-hostname instance map from that single pair of
+// RPCs. Services, InstancesByPort, and GetProxyServiceInstances all call this
+// when no Controller cache is wired, and Controller.refresh calls it once per
+// resync, so a read never costs more than the two RPCs regardless of how many
+// hostnames or instances they describe.
+func (sd *ServiceDiscovery) snapshot() ([]*model.Service, map[model.Hostname][]*model.ServiceInstance, error) {
 	resp, err := sd.Client.Routes(context.Background(), new(copilotapi.RoutesRequest))
 	if err != nil {
-		return nil, fmt.Errorf("getting routes: %s", err)
-	}
-	instances := make([]*model.ServiceInstance, 0)
-	backendSet := resp.GetBackends()[hostname.String()]
-	for _, backend := range backendSet.GetBackends() {
-		port := sd.servicePort()
-
-		instances = append(instances, &model.ServiceInstance{
-			Endpoint: model.NetworkEndpoint{
-				Address:     backend.Address,
-				Port:        int(backend.Port),
-				ServicePort: port,
-			},
-			Service: &model.Service{
-				Hostname:     hostname,
-				Ports:        []*model.Port{port},
-				MeshExternal: false,
-				Resolution:   model.ClientSideLB,
-			},
-		})
+		return nil, nil, fmt.Errorf("getting services: %s", err)
 	}
 
 	internalRoutesResp, err := sd.Client.InternalRoutes(context.Background(), new(copilotapi.InternalRoutesRequest))
 	if err != nil {
-		return nil, fmt.Errorf("getting internal routes: %s", err)
+		return nil, nil, fmt.Errorf("getting services: %s", err)
 	}
 
+	backends := resp.GetBackends()
+	internalRoutes := internalRoutesResp.GetInternalRoutes()
+	services := make([]*model.Service, 0, len(backends)+len(internalRoutes))
+	instances := make(map[model.Hostname][]*model.ServiceInstance, len(backends)+len(internalRoutes))
+
 	internalRouteServicePort := &model.Port{
 		Port:     sd.ServicePort,
 		Protocol: model.ProtocolTCP,
 		Name:     "tcp",
 	}
 
-	for _, internalRoute := range internalRoutesResp.GetInternalRoutes() {
-		for _, backend := range internalRoute.GetBackends().Backends {
-			if internalRoute.Hostname == hostname.String() {
-				instances = append(instances, &model.ServiceInstance{
-					Endpoint: model.NetworkEndpoint{
-						Address:     backend.Address,
-						Port:        int(backend.Port),
-						ServicePort: internalRouteServicePort,
-					},
-					Service: &model.Service{
-						Hostname:     hostname,
-						Address:      internalRoute.Vip,
-						Ports:        []*model.Port{internalRouteServicePort},
-						MeshExternal: false,
-						Resolution:   model.ClientSideLB,
-					},
-				})
-			}
+	for hostname, backendSet := range backends {
+		host := model.Hostname(hostname)
+		ports := sd.resolvePorts(host, backendSet.GetBackends(), sd.servicePort())
+		svc := &model.Service{
+			Hostname:     host,
+			Ports:        ports,
+			MeshExternal: false,
+			Resolution:   model.ClientSideLB,
+		}
+		services = append(services, svc)
+
+		labels := sd.labelResolver().ResolveLabels(host)
+		for _, backend := range backendSet.GetBackends() {
+			instances[host] = append(instances[host], &model.ServiceInstance{
+				Endpoint: model.NetworkEndpoint{
+					Address:     backend.Address,
+					Port:        int(backend.Port),
+					ServicePort: matchPort(ports, backend.Port),
+				},
+				Service: svc,
+				Labels:  labels,
+			})
+		}
+	}
+
+	for _, internalRoute := range internalRoutes {
+		host := model.Hostname(internalRoute.Hostname)
+		ports := sd.resolvePorts(host, internalRoute.GetBackends().GetBackends(), internalRouteServicePort)
+		svc := &model.Service{
+			Hostname:     host,
+			Address:      internalRoute.Vip,
+			Ports:        ports,
+			MeshExternal: false,
+			Resolution:   model.ClientSideLB,
+		}
+		services = append(services, svc)
+
+		labels := sd.labelResolver().ResolveLabels(host)
+		for _, backend := range internalRoute.GetBackends().GetBackends() {
+			instances[host] = append(instances[host], &model.ServiceInstance{
+				Endpoint: model.NetworkEndpoint{
+					Address:     backend.Address,
+					Port:        int(backend.Port),
+					ServicePort: matchPort(ports, backend.Port),
+				},
+				Service: svc,
+				Labels:  labels,
+			})
 		}
 	}
 
-	return instances, nil
+	services = append(services, sd.Egress.Services()...)
+
+	return services, instances, nil
 }
 
-// GetProxyServiceInstances returns all service instances running on a particular proxy
-// Cloud Foundry integration is currently ingress-only -- there is no sidecar support yet.
-// So this function always returns an empty slice.
-func (sd *ServiceDiscovery) GetProxyServiceInstances(proxy *model.Proxy) ([]*model.ServiceInstance, error) {
-	return nil, nil
+// ip2InstanceFrom builds an index of container address to the service
+// instances registered at that address, given a snapshot's instances-by-hostname
+// map, so a CF sidecar registering with its container IP can be matched back
+// to the app it collocates with.
+func ip2InstanceFrom(instances map[model.Hostname][]*model.ServiceInstance) map[string][]*model.ServiceInstance {
+	ip2instance := make(map[string][]*model.ServiceInstance)
+	for _, hostInstances := range instances {
+		for _, instance := range hostInstances {
+			ip2instance[instance.Endpoint.Address] = append(ip2instance[instance.Endpoint.Address], instance)
+		}
+	}
+	return ip2instance
+}
+
+// resolvePorts returns sd.PortResolver's ports for hostname when one is
+// configured and it knows something more specific than fallback; otherwise it
+// derives them from backends via discoverPorts.
+func (sd *ServiceDiscovery) resolvePorts(hostname model.Hostname, backends []*copilotapi.Backend, fallback *model.Port) []*model.Port {
+	if sd.PortResolver != nil {
+		ports := sd.PortResolver.ResolvePorts(hostname, fallback)
+		if len(ports) != 1 || ports[0] != fallback {
+			return ports
+		}
+	}
+	return discoverPorts(backends, fallback)
 }
 
 // ManagementPorts is not currently implemented for Cloud Foundry
@@ -0,0 +1,219 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudfoundry
+
+import (
+	"errors"
+	"testing"
+
+	copilotapi "code.cloudfoundry.org/copilot/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// errShouldNotBeCalled is returned by a fakeCopilotClient that asserts
+// InstancesByPort short-circuits on an egress match before ever reaching Copilot.
+var errShouldNotBeCalled = errors.New("copilot should not have been called for an egress host")
+
+// fakeCopilotClient is a hand-rolled stand-in for copilotClient. The package
+// normally generates one via counterfeiter (see the go:generate directive on
+// copilotClient), but that needs the vendored proto to run against; this
+// fake only needs to satisfy the two RPCs ServiceDiscovery actually calls.
+type fakeCopilotClient struct {
+	routesResp         *copilotapi.RoutesResponse
+	internalRoutesResp *copilotapi.InternalRoutesResponse
+	err                error
+}
+
+func (f *fakeCopilotClient) Health(ctx context.Context, in *copilotapi.HealthRequest, opts ...grpc.CallOption) (*copilotapi.HealthStatus, error) {
+	return &copilotapi.HealthStatus{}, nil
+}
+
+func (f *fakeCopilotClient) Routes(ctx context.Context, in *copilotapi.RoutesRequest, opts ...grpc.CallOption) (*copilotapi.RoutesResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.routesResp == nil {
+		return &copilotapi.RoutesResponse{}, nil
+	}
+	return f.routesResp, nil
+}
+
+func (f *fakeCopilotClient) InternalRoutes(ctx context.Context, in *copilotapi.InternalRoutesRequest, opts ...grpc.CallOption) (*copilotapi.InternalRoutesResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.internalRoutesResp == nil {
+		return &copilotapi.InternalRoutesResponse{}, nil
+	}
+	return f.internalRoutesResp, nil
+}
+
+func TestServicesFromPublicAndInternalRoutes(t *testing.T) {
+	client := &fakeCopilotClient{
+		routesResp: &copilotapi.RoutesResponse{
+			Backends: map[string]*copilotapi.BackendSet{
+				"public.apps.example.com": {
+					Backends: []*copilotapi.Backend{{Address: "10.0.0.1", Port: 8080}},
+				},
+			},
+		},
+		internalRoutesResp: &copilotapi.InternalRoutesResponse{
+			InternalRoutes: []*copilotapi.InternalRouteWithBackends{{
+				Hostname: "internal.apps.internal",
+				Vip:      "10.255.0.1",
+				Backends: &copilotapi.BackendSet{
+					Backends: []*copilotapi.Backend{{Address: "10.0.0.2", Port: 6868}},
+				},
+			}},
+		},
+	}
+	sd := &ServiceDiscovery{Client: client, ServicePort: 8080}
+
+	services, err := sd.Services()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected 2 services, got %d: %+v", len(services), services)
+	}
+
+	byHost := map[model.Hostname]*model.Service{}
+	for _, svc := range services {
+		byHost[svc.Hostname] = svc
+	}
+
+	public := byHost["public.apps.example.com"]
+	if public == nil {
+		t.Fatal("expected a service for the public route")
+	}
+	if public.Address != "" {
+		t.Errorf("expected no VIP for a public route, got %q", public.Address)
+	}
+
+	internal := byHost["internal.apps.internal"]
+	if internal == nil {
+		t.Fatal("expected a service for the internal route")
+	}
+	if internal.Address != "10.255.0.1" {
+		t.Errorf("expected the internal route's VIP to carry over, got %q", internal.Address)
+	}
+}
+
+func TestInstancesByPortDerivesFromBackends(t *testing.T) {
+	client := &fakeCopilotClient{
+		routesResp: &copilotapi.RoutesResponse{
+			Backends: map[string]*copilotapi.BackendSet{
+				"app.example.com": {
+					Backends: []*copilotapi.Backend{
+						{Address: "10.0.0.1", Port: 8080},
+						{Address: "10.0.0.2", Port: 8080},
+					},
+				},
+			},
+		},
+	}
+	labels := model.Labels{"cloudfoundry.org/app-guid": "abc-123"}
+	sd := &ServiceDiscovery{
+		Client:        client,
+		ServicePort:   8080,
+		LabelResolver: NewStaticLabelResolver(map[model.Hostname]model.Labels{"app.example.com": labels}),
+	}
+
+	instances, err := sd.InstancesByPort("app.example.com", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 instances, got %d: %+v", len(instances), instances)
+	}
+	for _, instance := range instances {
+		if instance.Endpoint.Port != 8080 {
+			t.Errorf("expected port 8080, got %d", instance.Endpoint.Port)
+		}
+		if instance.Labels["cloudfoundry.org/app-guid"] != "abc-123" {
+			t.Errorf("expected the resolved app-guid label to propagate, got %+v", instance.Labels)
+		}
+	}
+}
+
+func TestInstancesByPortEgressHostReturnsNilWithoutCallingCopilot(t *testing.T) {
+	client := &fakeCopilotClient{err: errShouldNotBeCalled}
+	sd := &ServiceDiscovery{
+		Client: client,
+		Egress: &EgressRuleset{rules: []EgressRule{{Host: "*.partner.com"}}},
+	}
+
+	instances, err := sd.InstancesByPort("billing.partner.com", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if instances != nil {
+		t.Errorf("expected no instances for an egress host, got %+v", instances)
+	}
+}
+
+func TestGetProxyServiceInstancesByContainerIP(t *testing.T) {
+	client := &fakeCopilotClient{
+		routesResp: &copilotapi.RoutesResponse{
+			Backends: map[string]*copilotapi.BackendSet{
+				"app.example.com": {
+					Backends: []*copilotapi.Backend{{Address: "10.0.0.1", Port: 8080}},
+				},
+			},
+		},
+	}
+	sd := &ServiceDiscovery{Client: client, ServicePort: 8080}
+
+	instances, err := sd.GetProxyServiceInstances(&model.Proxy{IPAddress: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("expected 1 instance collocated with the proxy, got %d: %+v", len(instances), instances)
+	}
+
+	if instances, err := sd.GetProxyServiceInstances(&model.Proxy{IPAddress: "10.0.0.99"}); err != nil || len(instances) != 0 {
+		t.Errorf("expected no instances for an unrelated proxy IP, got %+v, %v", instances, err)
+	}
+}
+
+func TestPortResolverOverridesDiscoverPorts(t *testing.T) {
+	client := &fakeCopilotClient{
+		routesResp: &copilotapi.RoutesResponse{
+			Backends: map[string]*copilotapi.BackendSet{
+				"grpc.apps.example.com": {
+					Backends: []*copilotapi.Backend{{Address: "10.0.0.1", Port: 8080}},
+				},
+			},
+		},
+	}
+	override := []*model.Port{{Port: 8080, Protocol: model.ProtocolGRPC, Name: "grpc"}}
+	sd := &ServiceDiscovery{
+		Client:       client,
+		ServicePort:  8080,
+		PortResolver: NewPortResolver(map[model.Hostname][]*model.Port{"grpc.apps.example.com": override}),
+	}
+
+	svc, err := sd.GetService("grpc.apps.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if svc == nil || len(svc.Ports) != 1 || svc.Ports[0].Protocol != model.ProtocolGRPC {
+		t.Errorf("expected PortResolver's override to win over discoverPorts, got %+v", svc)
+	}
+}